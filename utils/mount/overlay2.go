@@ -19,26 +19,94 @@ package mount
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/base32"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alibaba/sealer/logger"
 	"github.com/alibaba/sealer/utils"
 	"github.com/alibaba/sealer/utils/ssh"
 	"github.com/shirou/gopsutil/disk"
+	"golang.org/x/sys/unix"
 )
 
+// mountDataLimit is the maximum size of the "data" argument accepted by the
+// mount(2) syscall (PAGE_SIZE on all supported architectures).
+const mountDataLimit = 4096
+
+// fusePIDFile stores the pid of the mount-program process below target, so
+// Unmount can find and tear it down again.
+const fusePIDFile = ".fuse-pid"
+
+// defaultMountProgram is used whenever Overlay2.MountProgram is unset and the
+// kernel overlay driver cannot be used directly.
+const defaultMountProgram = "fuse-overlayfs"
+
+// lowerLinksDir is the per-target directory of short symlinks used to keep
+// the lowerdir= option under the mount(2) data page-size limit.
+const lowerLinksDir = "l"
+
+// lowerLinkIDBytes is the amount of randomness backing each symlink name
+// (16 bytes base32-encodes to ~26 characters).
+const lowerLinkIDBytes = 16
+
+// mountProgramReadyTimeout and mountProgramReadyPoll bound how long
+// mountWithProgram waits for a mount program to actually establish its
+// mount before reporting success.
+const mountProgramReadyTimeout = 10 * time.Second
+const mountProgramReadyPoll = 50 * time.Millisecond
+
 type Interface interface {
 	// Mount merged layer files
 	Mount(target string, upperDir string, layers ...string) error
 	Unmount(target string) error
 }
 
+// Mount describes a generic, fstab-style mount request: mount Source onto
+// Target as Type, with Options parsed the way /etc/fstab would (see
+// ParseMountOptions). It lets callers describe bind mounts, tmpfs build
+// caches and remount-ro passes uniformly, instead of only supporting
+// overlay2 through the bespoke Mount/Unmount API above.
+type Mount struct {
+	Source  string
+	Target  string
+	Type    string
+	Options []string
+}
+
 type Overlay2 struct {
+	// MountProgram, when set, forces mounting through a user-space fuse
+	// mount program (e.g. fuse-overlayfs) instead of the kernel overlay
+	// driver. When empty, Mount still falls back to defaultMountProgram
+	// if the kernel driver turns out to be unusable.
+	MountProgram string
+
+	// UIDMaps and GIDMaps, when set, idmap every lower layer's ownership
+	// on the fly via mount_setattr(MOUNT_ATTR_IDMAP), so layers built as
+	// root can be mounted into a rootless user namespace without
+	// chowning the underlying layer store. Ignored on kernels older than
+	// 5.19, which lack idmapped mount support.
+	UIDMaps []IDMap
+	GIDMaps []IDMap
+}
+
+// IDMap describes one line of a uid or gid mapping range: Size consecutive
+// ids starting at ContainerID map to the Size consecutive ids starting at
+// HostID.
+type IDMap struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
 }
 
 func NewMountDriver() Interface {
@@ -48,6 +116,14 @@ func NewMountDriver() Interface {
 	return &Default{}
 }
 
+// NewMountDriverWithProgram is like NewMountDriver but forces mounting
+// through mountProgram (e.g. fuse-overlayfs), bypassing the kernel overlay
+// driver entirely. This is for rootless environments such as unprivileged
+// CI containers where syscall.Mount will always fail.
+func NewMountDriverWithProgram(mountProgram string) Interface {
+	return &Overlay2{MountProgram: mountProgram}
+}
+
 func supportsOverlay() bool {
 	if err := exec.Command("modprobe", "overlay").Run(); err != nil {
 		return false
@@ -79,6 +155,7 @@ func (o *Overlay2) Mount(target string, upperLayer string, layers ...string) err
 		return fmt.Errorf("layers cannot be empty")
 	}
 	workdir := path.Join(target, "work")
+	linkDir := path.Join(target, lowerLinksDir)
 	if err := utils.Mkdir(workdir); err != nil {
 		return fmt.Errorf("create workdir failed")
 	}
@@ -86,6 +163,7 @@ func (o *Overlay2) Mount(target string, upperLayer string, layers ...string) err
 	defer func() {
 		if err != nil {
 			_ = os.RemoveAll(workdir)
+			_ = os.RemoveAll(linkDir)
 		}
 	}()
 
@@ -101,19 +179,605 @@ func (o *Overlay2) Mount(target string, upperLayer string, layers ...string) err
 		logger.Warn("Unable to detect whether overlay kernel module supports index parameter: %s", err)
 	}
 
-	mountData := fmt.Sprintf("%slowerdir=%s,upperdir=%s,workdir=%s", indexOff, strings.Join(utils.Reverse(layers), ":"), upperLayer, workdir)
+	viaMountProgram := o.willUseMountProgram()
+	lowerDir, idmapFiles, idmapCleanup, err := o.prepareLowerDir(linkDir, utils.Reverse(layers), viaMountProgram)
+	if err != nil {
+		return err
+	}
+	defer idmapCleanup()
+
+	mountData := fmt.Sprintf("%slowerdir=%s,upperdir=%s,workdir=%s", indexOff, lowerDir, upperLayer, workdir)
 	logger.Debug("mount data : %s", mountData)
-	if err = mount("overlay", target, "overlay", 0, mountData); err != nil {
+	if viaMountProgram || o.useMountProgram(mountData) {
+		err = o.mountWithProgram(target, mountData, idmapFiles)
+		return err
+	}
+	// lowerDir is made of paths relative to target (e.g. l/AAA), so the
+	// mount syscall must be issued with target as the working directory.
+	if err = mountRelativeTo(target, "overlay", target, "overlay", 0, mountData); err != nil {
 		return fmt.Errorf("error creating overlay mount to %s: %v", target, err)
 	}
 	return nil
 }
 
+// MountReadOnly mounts layers as a read-only overlay at target, with no
+// upperdir/workdir: the kernel rejects an overlay mount that carries an
+// upperdir without write semantics. It also rejects a lowerdir-only mount
+// that has just a single layer, so when only one layer is supplied an empty
+// scratch directory is synthesized and appended as a second lower.
+func (o *Overlay2) MountReadOnly(target string, layers ...string) error {
+	if target == "" {
+		return fmt.Errorf("target cannot be empty")
+	}
+	if len(layers) == 0 {
+		return fmt.Errorf("layers cannot be empty")
+	}
+
+	linkDir := path.Join(target, lowerLinksDir)
+	var err error
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(linkDir)
+		}
+	}()
+
+	lowers := utils.Reverse(layers)
+	if len(lowers) == 1 {
+		empty := path.Join(target, "empty")
+		if err = utils.Mkdir(empty); err != nil {
+			return fmt.Errorf("create empty scratch lower failed: %v", err)
+		}
+		lowers = append(lowers, empty)
+	}
+
+	viaMountProgram := o.willUseMountProgram()
+	lowerDir, idmapFiles, idmapCleanup, err := o.prepareLowerDir(linkDir, lowers, viaMountProgram)
+	if err != nil {
+		return err
+	}
+	defer idmapCleanup()
+
+	mountData := fmt.Sprintf("lowerdir=%s", lowerDir)
+	logger.Debug("read-only mount data : %s", mountData)
+	if viaMountProgram || o.useMountProgram(mountData) {
+		err = o.mountWithProgram(target, mountData, idmapFiles)
+		return err
+	}
+	if err = mountRelativeTo(target, "overlay", target, "overlay", 0, mountData); err != nil {
+		return fmt.Errorf("error creating read-only overlay mount to %s: %v", target, err)
+	}
+	return nil
+}
+
+// prepareLowerDir idmaps layers (if o.UIDMaps/o.GIDMaps are set and the
+// kernel supports it) and lays the result out under linkDir as a
+// "l/AAA:l/BBB:..." lowerdir value, shared by Mount and MountReadOnly so
+// both honor the driver's idmap configuration the same way. idmapFiles is
+// non-empty only when idmap was actually applied; the caller must keep
+// those fds open at least through the subsequent mount(2)/mount-program
+// call and run cleanup afterwards. forMountProgram must reflect whether the
+// caller will end up mounting through a separate mount-program process (see
+// willUseMountProgram), since that changes which fd numbers the idmapped
+// lower symlinks need to target.
+func (o *Overlay2) prepareLowerDir(linkDir string, layers []string, forMountProgram bool) (lowerDir string, idmapFiles []*os.File, cleanup func(), err error) {
+	lowers := layers
+	cleanup = func() {}
+	if len(o.UIDMaps) > 0 || len(o.GIDMaps) > 0 {
+		if supportsIdmappedMounts() {
+			idmapped, files, idmapCleanup, idmapErr := idmapLowerDirs(layers, o.UIDMaps, o.GIDMaps, forMountProgram)
+			if idmapErr != nil {
+				return "", nil, nil, fmt.Errorf("failed to create idmapped lower layers: %v", idmapErr)
+			}
+			lowers = idmapped
+			idmapFiles = files
+			cleanup = idmapCleanup
+		} else {
+			logger.Warn("kernel does not support idmapped mounts (needs >= %d.%d); mounting lower layers as-is", idmapMinKernelMajor, idmapMinKernelMinor)
+		}
+	}
+
+	lowerDir, err = linkLowerDirs(linkDir, lowers)
+	if err != nil {
+		cleanup()
+		return "", nil, nil, fmt.Errorf("failed to prepare lowerdir: %v", err)
+	}
+	return lowerDir, idmapFiles, cleanup, nil
+}
+
+// linkLowerDirs creates linkDir and, for every layer, a short random symlink
+// inside it pointing at the layer's absolute path. It returns the
+// corresponding "l/AAA:l/BBB:..." lowerdir value, which stays well under the
+// mount(2) single-page data limit even for deep image layer stacks.
+func linkLowerDirs(linkDir string, layers []string) (string, error) {
+	if err := utils.Mkdir(linkDir); err != nil {
+		return "", fmt.Errorf("create lower links dir failed: %v", err)
+	}
+	rel := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		id, err := generateLowerLinkID()
+		if err != nil {
+			return "", err
+		}
+		if err := os.Symlink(layer, path.Join(linkDir, id)); err != nil {
+			return "", fmt.Errorf("failed to link lower %s: %v", layer, err)
+		}
+		rel = append(rel, path.Join(lowerLinksDir, id))
+	}
+	return strings.Join(rel, ":"), nil
+}
+
+// generateLowerLinkID returns a short random, filesystem-safe name for a
+// lowerdir symlink.
+func generateLowerLinkID() (string, error) {
+	b := make([]byte, lowerLinkIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lower link id: %v", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// chdirMountMu serializes mountRelativeTo's chdir/mount/chdir-back sequence.
+// Go threads share a single fs_struct (cwd) process-wide, so
+// runtime.LockOSThread alone does not make the chdir below thread-local; a
+// real mutex is needed to keep a concurrent mountRelativeTo call, or any
+// other goroutine's relative-path I/O, from observing the wrong cwd while
+// it's in flight.
+var chdirMountMu sync.Mutex
+
+// mountRelativeTo chdirs to dir before issuing the mount syscall, so that
+// relative paths embedded in data (e.g. lowerdir=l/AAA) resolve against dir
+// rather than the process's usual working directory.
+func mountRelativeTo(dir string, device, target, mType string, flag uintptr, data string) error {
+	chdirMountMu.Lock()
+	defer chdirMountMu.Unlock()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Chdir(cwd)
+	}()
+
+	return mount(device, target, mType, flag, data)
+}
+
+// useMountProgram reports whether target should be mounted through a
+// user-space fuse mount program rather than the kernel overlay driver: the
+// driver was explicitly configured to do so, the kernel would reject
+// mountData for exceeding the single-page mount data limit, or the caller
+// lacks the privilege (CAP_SYS_ADMIN) that syscall.Mount requires.
+func (o *Overlay2) useMountProgram(mountData string) bool {
+	if o.willUseMountProgram() {
+		return true
+	}
+	return len(mountData) >= mountDataLimit
+}
+
+// willUseMountProgram predicts, before the lowerdir layout is built, whether
+// Mount/MountReadOnly will end up mounting through a mount program rather
+// than the kernel driver. prepareLowerDir needs this ahead of time: when the
+// mount program will run as a separate process, idmapped lower symlinks must
+// target that child's future fd numbers (/proc/self/fd/3, /proc/self/fd/4,
+// ...), since "/proc/self/fd/<n>" referring to this process's own fd table
+// doesn't resolve inside the child. This covers the same ground as
+// useMountProgram except for the mountData length check, which depends on
+// the already-compacted lowerDir and isn't affected by idmap either way.
+func (o *Overlay2) willUseMountProgram() bool {
+	return o.MountProgram != "" || !hasSysAdminCap()
+}
+
+// waitForMountProgram blocks until target shows up as a mount point in
+// /proc/self/mountinfo, or mountProgramReadyTimeout elapses. cmd.Start only
+// confirms the mount program launched, not that it finished initializing and
+// actually mounted target; without this, a caller that immediately
+// reads/writes target once Mount returns can race a still-initializing fuse
+// process, or silently proceed against an unmounted directory if the
+// process crashed right after forking.
+func waitForMountProgram(target string) error {
+	deadline := time.Now().Add(mountProgramReadyTimeout)
+	for {
+		if isMountPoint(target) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for mount", mountProgramReadyTimeout)
+		}
+		time.Sleep(mountProgramReadyPoll)
+	}
+}
+
+// isMountPoint reports whether target is listed as a mount point in
+// /proc/self/mountinfo, regardless of filesystem type (a mount program's
+// mount shows up as fuse.<program>, not overlay, so this can't reuse
+// findOverlayMount's fsType check).
+func isMountPoint(target string) bool {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		entry, ok := parseMountInfoLine(s.Text())
+		if ok && entry.mountPoint == target {
+			return true
+		}
+	}
+	return false
+}
+
+// mountWithProgram mounts target by invoking a user-space mount program,
+// e.g. fuse-overlayfs, passing it the same overlay options string the
+// kernel driver would have used. This mirrors buildah's
+// mountWithMountProgram and lets unprivileged callers build images without
+// CAP_SYS_ADMIN. idmapFiles carries any idmapped-lower tree fds
+// prepareLowerDir opened in this process; they're passed through via
+// ExtraFiles, and mountData's "/proc/self/fd/<n>" references already target
+// the resulting child fd numbers (see idmapLowerDirs's forMountProgram
+// parameter), since rewriting them after the fact would require mountData
+// to still contain this process's fd numbers, which the compacted
+// lowerdir=l/AAA,... form never does.
+func (o *Overlay2) mountWithProgram(target string, mountData string, idmapFiles []*os.File) error {
+	program := o.MountProgram
+	if program == "" {
+		program = defaultMountProgram
+	}
+	cmd := exec.Command(program, "-o", mountData, target)
+	// mountData may reference lowerdirs as target-relative symlinks
+	// (e.g. l/AAA), so run the mount program from inside target.
+	cmd.Dir = target
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = idmapFiles
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", program, err)
+	}
+
+	if err := waitForMountProgram(target); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("%s did not mount %s: %v", program, target, err)
+	}
+
+	// Record both the pid and the program it runs, so Unmount can tell a
+	// still-running mount-program process apart from an unrelated process
+	// the kernel has since recycled that pid to.
+	pidFile := path.Join(target, fusePIDFile)
+	pidFileContent := fmt.Sprintf("%d\n%s", cmd.Process.Pid, program)
+	if err := ioutil.WriteFile(pidFile, []byte(pidFileContent), 0644); err != nil {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("failed to persist %s pid: %v", program, err)
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.Warn("%s on %s exited: %v", program, target, err)
+		}
+	}()
+	return nil
+}
+
 // Unmount target
 func (o *Overlay2) Unmount(target string) error {
+	if pid, program, ok := readFusePID(target); ok {
+		return unmountWithProgram(target, pid, program)
+	}
 	return unmount(target, syscall.MNT_FORCE)
 }
 
+// readFusePID returns the pid and program path recorded by mountWithProgram
+// for target, if target was mounted through a mount program rather than the
+// kernel driver.
+func readFusePID(target string) (pid int, program string, ok bool) {
+	data, err := ioutil.ReadFile(path.Join(target, fusePIDFile))
+	if err != nil {
+		return 0, "", false
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)
+	if len(fields) != 2 {
+		return 0, "", false
+	}
+	pid, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", false
+	}
+	return pid, fields[1], true
+}
+
+// unmountWithProgram detaches a mount created by mountWithProgram and tears
+// down its backing process.
+func unmountWithProgram(target string, pid int, program string) error {
+	if err := unmount(target, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("error unmounting fuse mount at %s: %v", target, err)
+	}
+	if isMountProgramProcess(pid, program) {
+		if process, err := os.FindProcess(pid); err == nil {
+			_ = process.Signal(syscall.SIGTERM)
+		}
+	}
+	return os.Remove(path.Join(target, fusePIDFile))
+}
+
+// isMountProgramProcess reports whether pid is still running program,
+// guarding against the kernel having recycled pid for an unrelated process
+// by the time Unmount runs (the mount program may have crashed, or already
+// been reaped by the cmd.Wait goroutine in mountWithProgram).
+func isMountProgramProcess(pid int, program string) bool {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return false
+	}
+	want := program
+	if resolved, err := exec.LookPath(program); err == nil {
+		want = resolved
+	}
+	return exe == want || path.Base(exe) == path.Base(want)
+}
+
+// hasSysAdminCap reports whether the current process has CAP_SYS_ADMIN in
+// its effective capability set, which syscall.Mount requires for anything
+// other than a handful of unprivileged mount types.
+func hasSysAdminCap() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	const capSysAdmin = uint(21)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return false
+		}
+		capEff, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return false
+		}
+		return capEff&(1<<capSysAdmin) != 0
+	}
+	return false
+}
+
+// idmapMinKernelMajor and idmapMinKernelMinor are the first kernel version
+// to support idmapped mounts (MOUNT_ATTR_IDMAP via mount_setattr(2)).
+const idmapMinKernelMajor = 5
+const idmapMinKernelMinor = 19
+
+// supportsIdmappedMounts reports whether the running kernel is new enough
+// to support idmapped mounts, falling back to the standard (non-idmapped)
+// code path when it isn't. It uses golang.org/x/sys/unix.Uname rather than
+// syscall.Uname: syscall.Utsname.Release is [65]int8 on amd64/arm64 but
+// [65]uint8 on other architectures such as arm, whereas unix.Utsname
+// normalizes that across architectures.
+func supportsIdmappedMounts() bool {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false
+	}
+	major, minor, ok := parseKernelRelease(unix.ByteSliceToString(uts.Release[:]))
+	if !ok {
+		return false
+	}
+	if major != idmapMinKernelMajor {
+		return major > idmapMinKernelMajor
+	}
+	return minor >= idmapMinKernelMinor
+}
+
+// parseKernelRelease parses the "major.minor" prefix of a uname release
+// string such as "5.19.0-generic".
+func parseKernelRelease(release string) (major, minor int, ok bool) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	minorDigits := parts[1]
+	for i, r := range minorDigits {
+		if r < '0' || r > '9' {
+			minorDigits = minorDigits[:i]
+			break
+		}
+	}
+	var err1, err2 error
+	major, err1 = strconv.Atoi(parts[0])
+	minor, err2 = strconv.Atoi(minorDigits)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// idmapLowerDirs idmaps every layer in layers into a throwaway user
+// namespace built from uidMaps/gidMaps, via
+// open_tree(OPEN_TREE_CLONE)+mount_setattr(MOUNT_ATTR_IDMAP), and returns
+// "/proc/self/fd/<n>" paths referencing the resulting idmapped mounts,
+// alongside the *os.File wrapping each fd. When forMountProgram is false,
+// <n> is this process's own fd number, valid for the kernel driver's
+// in-process mount(2) call. When forMountProgram is true, the mount happens
+// in a separate mount-program process that receives these files via
+// exec.Cmd.ExtraFiles (entry i becomes fd 3+i there), so <n> is that future
+// child fd number instead -- this process's own fd number would resolve to
+// the wrong (or no) file once looked up inside the child's /proc/self.
+// Either way the caller keeps the returned files open at least through the
+// eventual mount call; overlayfs takes its own reference to each idmapped
+// mount when it resolves the /proc/self/fd path during that mount, so the
+// lower layers keep working once the caller's cleanup func closes the files
+// afterwards.
+func idmapLowerDirs(layers []string, uidMaps, gidMaps []IDMap, forMountProgram bool) ([]string, []*os.File, func(), error) {
+	usernsFd, err := newIDMappedUserNamespace(uidMaps, gidMaps)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer syscall.Close(usernsFd)
+
+	files := make([]*os.File, 0, len(layers))
+	cleanup := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+
+	idmapped := make([]string, 0, len(layers))
+	for i, layer := range layers {
+		treeFd, err := unix.OpenTree(unix.AT_FDCWD, layer, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("open_tree(%s) failed: %v", layer, err)
+		}
+		attr := unix.MountAttr{
+			Attr_set:  unix.MOUNT_ATTR_IDMAP,
+			Userns_fd: uint64(usernsFd),
+		}
+		if err := unix.MountSetattr(treeFd, "", unix.AT_EMPTY_PATH, &attr); err != nil {
+			_ = syscall.Close(treeFd)
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("mount_setattr(%s) failed: %v", layer, err)
+		}
+		files = append(files, os.NewFile(uintptr(treeFd), layer))
+		fd := treeFd
+		if forMountProgram {
+			fd = 3 + i
+		}
+		idmapped = append(idmapped, fmt.Sprintf("/proc/self/fd/%d", fd))
+	}
+	return idmapped, files, cleanup, nil
+}
+
+// newIDMappedUserNamespace spawns a throwaway process in a fresh user
+// namespace with uidMaps/gidMaps applied, and returns an open fd to that
+// namespace (/proc/<pid>/ns/user). The helper (cat, reading from r) is only
+// needed long enough for the CLONE_NEWUSER fork to happen: this function
+// closes w and reaps it before returning, so by the time the fd is handed
+// back the helper process has already exited. That's fine -- the returned
+// fd itself pins the namespace open for as long as the caller keeps it open,
+// independent of the process that created it.
+func newIDMappedUserNamespace(uidMaps, gidMaps []IDMap) (int, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return -1, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command("cat")
+	cmd.Stdin = r
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: toSysProcIDMaps(uidMaps),
+		GidMappings: toSysProcIDMaps(gidMaps),
+	}
+	if err := cmd.Start(); err != nil {
+		_ = w.Close()
+		return -1, fmt.Errorf("failed to start idmap helper process: %v", err)
+	}
+	defer func() {
+		_ = w.Close()
+		_ = cmd.Wait()
+	}()
+
+	usernsFd, err := syscall.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid), syscall.O_RDONLY, 0)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return -1, fmt.Errorf("failed to open userns of idmap helper: %v", err)
+	}
+	return usernsFd, nil
+}
+
+func toSysProcIDMaps(maps []IDMap) []syscall.SysProcIDMap {
+	out := make([]syscall.SysProcIDMap, 0, len(maps))
+	for _, m := range maps {
+		out = append(out, syscall.SysProcIDMap{
+			ContainerID: int(m.ContainerID),
+			HostID:      int(m.HostID),
+			Size:        int(m.Size),
+		})
+	}
+	return out
+}
+
+// MountGeneric performs the mount described by m, parsing m.Options the way
+// /etc/fstab would via ParseMountOptions. It is not part of Interface: the
+// Default driver returned by NewMountDriver on overlay-less kernels has no
+// equivalent, since it never supported arbitrary fstab-style mounts either.
+func (o *Overlay2) MountGeneric(m Mount) error {
+	flags, data := ParseMountOptions(m.Options)
+	if err := mount(m.Source, m.Target, m.Type, flags, data); err != nil {
+		return fmt.Errorf("error mounting %s onto %s: %v", m.Source, m.Target, err)
+	}
+	return nil
+}
+
+type mountOptionFlag struct {
+	clear bool
+	flag  uintptr
+}
+
+// mountOptionFlags maps fstab-style option tokens to their corresponding
+// syscall.MS_* flags. "clear" tokens negate a flag set by another token
+// (e.g. "atime" clears MS_NOATIME set by a preceding "noatime").
+var mountOptionFlags = map[string]mountOptionFlag{
+	"defaults":    {false, 0},
+	"ro":          {false, syscall.MS_RDONLY},
+	"rw":          {true, syscall.MS_RDONLY},
+	"suid":        {true, syscall.MS_NOSUID},
+	"nosuid":      {false, syscall.MS_NOSUID},
+	"dev":         {true, syscall.MS_NODEV},
+	"nodev":       {false, syscall.MS_NODEV},
+	"exec":        {true, syscall.MS_NOEXEC},
+	"noexec":      {false, syscall.MS_NOEXEC},
+	"sync":        {false, syscall.MS_SYNCHRONOUS},
+	"async":       {true, syscall.MS_SYNCHRONOUS},
+	"dirsync":     {false, syscall.MS_DIRSYNC},
+	"remount":     {false, syscall.MS_REMOUNT},
+	"mand":        {false, syscall.MS_MANDLOCK},
+	"nomand":      {true, syscall.MS_MANDLOCK},
+	"atime":       {true, syscall.MS_NOATIME},
+	"noatime":     {false, syscall.MS_NOATIME},
+	"diratime":    {true, syscall.MS_NODIRATIME},
+	"nodiratime":  {false, syscall.MS_NODIRATIME},
+	"bind":        {false, syscall.MS_BIND},
+	"rbind":       {false, syscall.MS_BIND | syscall.MS_REC},
+	"private":     {false, syscall.MS_PRIVATE},
+	"rprivate":    {false, syscall.MS_PRIVATE | syscall.MS_REC},
+	"shared":      {false, syscall.MS_SHARED},
+	"rshared":     {false, syscall.MS_SHARED | syscall.MS_REC},
+	"slave":       {false, syscall.MS_SLAVE},
+	"rslave":      {false, syscall.MS_SLAVE | syscall.MS_REC},
+	"relatime":    {false, syscall.MS_RELATIME},
+	"norelatime":  {true, syscall.MS_RELATIME},
+	"strictatime": {false, syscall.MS_STRICTATIME},
+}
+
+// ParseMountOptions maps fstab-style option tokens (bind, ro, nosuid, nodev,
+// noexec, remount, relatime, noatime, private, shared, slave, rbind, ...) to
+// the syscall.MS_* flags they represent. A token whose entry is marked
+// "clear" (e.g. "atime" relative to "noatime") clears that bit instead of
+// setting it, so later tokens can undo earlier ones the way fstab option
+// lists do. Tokens that don't map to a flag accumulate, comma separated,
+// into data.
+func ParseMountOptions(opts []string) (flags uintptr, data string) {
+	var extra []string
+	for _, opt := range opts {
+		if f, ok := mountOptionFlags[opt]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+			continue
+		}
+		extra = append(extra, opt)
+	}
+	return flags, strings.Join(extra, ",")
+}
+
 func mount(device, target, mType string, flag uintptr, data string) error {
 	if err := syscall.Mount(device, target, mType, flag, data); err != nil {
 		return err
@@ -136,40 +800,131 @@ type Info struct {
 	Lowers []string
 }
 
+// GetMountDetails reads /proc/self/mountinfo and returns the overlay Info
+// for target, if any.
 func GetMountDetails(target string) (bool, *Info) {
-	cmd := fmt.Sprintf("mount | grep %s", target)
-	result, err := utils.RunSimpleCmd(cmd)
+	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
 		return false, nil
 	}
-	return mountCmdResultSplit(result, target)
+	defer f.Close()
+	return findOverlayMount(f, target)
 }
 
+// GetRemoteMountDetails is GetMountDetails for a remote host reached over s.
 func GetRemoteMountDetails(s ssh.Interface, ip string, target string) (bool, *Info) {
-	result, err := s.Cmd(ip, fmt.Sprintf("mount | grep %s", target))
+	result, err := s.Cmd(ip, "cat /proc/self/mountinfo")
 	if err != nil {
 		return false, nil
 	}
-	return mountCmdResultSplit(string(result), target)
+	return findOverlayMount(strings.NewReader(string(result)), target)
 }
 
-func mountCmdResultSplit(result string, target string) (bool, *Info) {
-	if !strings.Contains(result, target) {
-		return false, nil
+// findOverlayMount scans mountinfo (in the /proc/self/mountinfo format
+// described in proc(5)) for the overlay mount at target.
+func findOverlayMount(mountinfo io.Reader, target string) (bool, *Info) {
+	s := bufio.NewScanner(mountinfo)
+	for s.Scan() {
+		entry, ok := parseMountInfoLine(s.Text())
+		if !ok || entry.fsType != "overlay" || entry.mountPoint != target {
+			continue
+		}
+		lowerdir, upperdir, ok := parseOverlaySuperOptions(entry.superOptions)
+		if !ok {
+			continue
+		}
+		return true, &Info{
+			Target: target,
+			Upper:  upperdir,
+			Lowers: utils.Reverse(resolveLowerLinks(target, strings.Split(lowerdir, ":"))),
+		}
 	}
+	return false, nil
+}
 
-	data := strings.Split(result, ",upperdir=")
-	if len(data) < 2 {
-		return false, nil
+type mountInfoEntry struct {
+	mountPoint   string
+	fsType       string
+	superOptions string
+}
+
+// parseMountInfoLine parses one line of /proc/self/mountinfo:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// The "-" field is a literal separator between the fixed/optional fields and
+// the fsType/mountSource/superOptions triplet.
+func parseMountInfoLine(line string) (*mountInfoEntry, bool) {
+	fields := strings.Fields(line)
+	sepIdx := -1
+	for i, f := range fields {
+		if f == "-" {
+			sepIdx = i
+			break
+		}
 	}
+	if sepIdx < 5 || sepIdx+3 >= len(fields) {
+		return nil, false
+	}
+	return &mountInfoEntry{
+		mountPoint:   unescapeOctal(fields[4]),
+		fsType:       fields[sepIdx+1],
+		superOptions: fields[sepIdx+3],
+	}, true
+}
 
-	lowers := strings.Split(strings.Split(data[0], ",lowerdir=")[1], ":")
-	upper := strings.TrimSpace(strings.Split(data[1], ",workdir=")[0])
-	return true, &Info{
-		Target: target,
-		Upper:  upper,
-		Lowers: utils.Reverse(lowers),
+// unescapeOctal decodes the \NNN octal escapes proc(5) uses for spaces,
+// tabs, newlines and backslashes embedded in mountinfo path fields.
+func unescapeOctal(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseOverlaySuperOptions extracts lowerdir= and upperdir= out of an
+// overlay mount's comma-separated super options field. ok is false if no
+// lowerdir= was present, e.g. the super options belong to a different
+// filesystem.
+func parseOverlaySuperOptions(superOptions string) (lowerdir, upperdir string, ok bool) {
+	for _, opt := range strings.Split(superOptions, ",") {
+		switch {
+		case strings.HasPrefix(opt, "lowerdir="):
+			lowerdir = strings.TrimPrefix(opt, "lowerdir=")
+			ok = true
+		case strings.HasPrefix(opt, "upperdir="):
+			upperdir = strings.TrimPrefix(opt, "upperdir=")
+		}
+	}
+	return lowerdir, upperdir, ok
+}
+
+// resolveLowerLinks maps lowerdir entries that are target-relative symlinks
+// (e.g. l/AAA, produced by linkLowerDirs) back to the real, absolute layer
+// paths they point at, so Info.Lowers stays meaningful to callers.
+func resolveLowerLinks(target string, lowers []string) []string {
+	resolved := make([]string, 0, len(lowers))
+	for _, lower := range lowers {
+		if !strings.HasPrefix(lower, lowerLinksDir+"/") {
+			resolved = append(resolved, lower)
+			continue
+		}
+		real, err := os.Readlink(path.Join(target, lower))
+		if err != nil {
+			resolved = append(resolved, lower)
+			continue
+		}
+		resolved = append(resolved, real)
 	}
+	return resolved
 }
 
 func GetBuildMountInfo(filter string) []Info {
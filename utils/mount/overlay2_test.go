@@ -0,0 +1,167 @@
+// Copyright © 2021 Alibaba Group Holding Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package mount
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	cases := []struct {
+		name      string
+		opts      []string
+		wantFlags uintptr
+		wantData  string
+	}{
+		{
+			name:      "bind and ro combine",
+			opts:      []string{"bind", "ro"},
+			wantFlags: syscall.MS_BIND | syscall.MS_RDONLY,
+		},
+		{
+			name:      "rw clears a preceding ro",
+			opts:      []string{"ro", "rw"},
+			wantFlags: 0,
+		},
+		{
+			name:      "atime clears a preceding noatime",
+			opts:      []string{"noatime", "atime"},
+			wantFlags: 0,
+		},
+		{
+			name:      "rbind is bind plus recursive",
+			opts:      []string{"rbind"},
+			wantFlags: syscall.MS_BIND | syscall.MS_REC,
+		},
+		{
+			name:      "remount",
+			opts:      []string{"remount", "ro"},
+			wantFlags: syscall.MS_REMOUNT | syscall.MS_RDONLY,
+		},
+		{
+			name:      "unrecognized tokens accumulate into data",
+			opts:      []string{"bind", "size=64m", "mode=0755"},
+			wantFlags: syscall.MS_BIND,
+			wantData:  "size=64m,mode=0755",
+		},
+		{
+			name:      "empty options",
+			opts:      nil,
+			wantFlags: 0,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			flags, data := ParseMountOptions(c.opts)
+			if flags != c.wantFlags {
+				t.Errorf("ParseMountOptions(%v) flags = %#x, want %#x", c.opts, flags, c.wantFlags)
+			}
+			if data != c.wantData {
+				t.Errorf("ParseMountOptions(%v) data = %q, want %q", c.opts, data, c.wantData)
+			}
+		})
+	}
+}
+
+func TestParseKernelRelease(t *testing.T) {
+	cases := []struct {
+		release   string
+		wantMajor int
+		wantMinor int
+		wantOK    bool
+	}{
+		{release: "5.19.0-generic", wantMajor: 5, wantMinor: 19, wantOK: true},
+		{release: "6.2.0-1-amd64", wantMajor: 6, wantMinor: 2, wantOK: true},
+		{release: "4.15", wantMajor: 4, wantMinor: 15, wantOK: true},
+		{release: "not-a-version", wantOK: false},
+		{release: "5", wantOK: false},
+	}
+	for _, c := range cases {
+		major, minor, ok := parseKernelRelease(c.release)
+		if ok != c.wantOK {
+			t.Errorf("parseKernelRelease(%q) ok = %v, want %v", c.release, ok, c.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if major != c.wantMajor || minor != c.wantMinor {
+			t.Errorf("parseKernelRelease(%q) = %d.%d, want %d.%d", c.release, major, minor, c.wantMajor, c.wantMinor)
+		}
+	}
+}
+
+func TestUnescapeOctal(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: `/mnt`, want: "/mnt"},
+		{in: `/mnt\040with\040spaces`, want: "/mnt with spaces"},
+		{in: `back\134slash`, want: `back\slash`},
+		{in: `trailing\04`, want: `trailing\04`},
+	}
+	for _, c := range cases {
+		if got := unescapeOctal(c.in); got != c.want {
+			t.Errorf("unescapeOctal(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseMountInfoLine(t *testing.T) {
+	const line = `36 35 98:0 / /var/lib/sealer/data/overlay2/abc rw,relatime master:1 - overlay overlay rw,lowerdir=l/AAA:l/BBB,upperdir=/upper,workdir=/work`
+
+	entry, ok := parseMountInfoLine(line)
+	if !ok {
+		t.Fatalf("parseMountInfoLine(%q) returned ok = false", line)
+	}
+	if entry.mountPoint != "/var/lib/sealer/data/overlay2/abc" {
+		t.Errorf("mountPoint = %q", entry.mountPoint)
+	}
+	if entry.fsType != "overlay" {
+		t.Errorf("fsType = %q", entry.fsType)
+	}
+	if entry.superOptions != "rw,lowerdir=l/AAA:l/BBB,upperdir=/upper,workdir=/work" {
+		t.Errorf("superOptions = %q", entry.superOptions)
+	}
+
+	if _, ok := parseMountInfoLine("not a mountinfo line"); ok {
+		t.Error("parseMountInfoLine on a malformed line returned ok = true")
+	}
+}
+
+func TestResolveLowerLinks(t *testing.T) {
+	target := t.TempDir()
+	linkDir := filepath.Join(target, lowerLinksDir)
+	if err := os.Mkdir(linkDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	realLayer := filepath.Join(target, "layer1")
+	if err := os.Symlink(realLayer, filepath.Join(linkDir, "AAA")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := resolveLowerLinks(target, []string{"l/AAA", "/already/absolute"})
+	want := []string{realLayer, "/already/absolute"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("resolveLowerLinks = %v, want %v", got, want)
+	}
+}